@@ -0,0 +1,292 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// DPMechanism selects the noise distribution used by Privatize.
+type DPMechanism int
+
+const (
+	// Laplace adds Laplace-distributed noise, calibrated by Epsilon and
+	// Sensitivity alone.
+	Laplace DPMechanism = iota
+	// GaussianDiscrete adds noise drawn from a discrete Gaussian,
+	// calibrated by Epsilon, Delta, and Sensitivity.
+	GaussianDiscrete
+)
+
+// DPParams configures the differentially-private noise HealthAuthorityStats
+// .Privatize adds before an hour of stats leaves the server.
+type DPParams struct {
+	// Epsilon is the per-counter privacy budget; smaller means more noise.
+	Epsilon float64
+	// Delta is the failure probability used to size GaussianDiscrete noise.
+	// It is unused for Laplace.
+	Delta float64
+	// Sensitivity is the maximum a single publish can move any one
+	// counter, almost always 1.
+	Sensitivity int32
+	// Mechanism selects the noise distribution.
+	Mechanism DPMechanism
+}
+
+// Privatize returns a copy of h with calibrated noise added to every
+// per-platform counter and histogram bucket, so that aggregate stats can be
+// published without leaking small-cell counts. h itself is left untouched.
+//
+// Noised counters are clipped to zero, since a negative publish count is
+// meaningless, and each day histogram is proportionally rescaled so its
+// bucket counts never sum to more than the noised PublishCount for that
+// platform.
+//
+// rand supplies the randomness backing the noise draws. Production callers
+// should pass crypto/rand.Reader; tests can pass a seeded math/rand.Rand to
+// get deterministic output. Privatize panics if rand fails, since the only
+// realistic cause is a broken entropy source, which isn't recoverable.
+func (h *HealthAuthorityStats) Privatize(rand io.Reader, p DPParams) *HealthAuthorityStats {
+	out := h.clone()
+
+	noise := func() float64 {
+		switch p.Mechanism {
+		case GaussianDiscrete:
+			sigma := float64(p.Sensitivity) * math.Sqrt(2*math.Log(1.25/p.Delta)) / p.Epsilon
+			return float64(mustSampleDiscreteGaussian(rand, sigma))
+		default:
+			return mustSampleLaplace(rand, float64(p.Sensitivity)/p.Epsilon)
+		}
+	}
+
+	addNoise32 := func(v int32) int32 {
+		noised := int64(v) + int64(math.Round(noise()))
+		if noised < 0 {
+			return 0
+		}
+		return int32(noised)
+	}
+	addNoise64 := func(v int64) int64 {
+		noised := v + int64(math.Round(noise()))
+		if noised < 0 {
+			return 0
+		}
+		return noised
+	}
+
+	out.TEKCount = addNoise64(out.TEKCount)
+	out.RevisionCount = addNoise32(out.RevisionCount)
+	for i := range platforms {
+		out.PublishCount[i] = addNoise32(out.PublishCount[i])
+		out.MissingOnset[i] = addNoise32(out.MissingOnset[i])
+
+		for j := range out.OldestTekDays[i] {
+			out.OldestTekDays[i][j] = addNoise32(out.OldestTekDays[i][j])
+		}
+		rescaleHistogram(out.OldestTekDays[i], out.PublishCount[i])
+
+		for j := range out.OnsetAgeDays[i] {
+			out.OnsetAgeDays[i][j] = addNoise32(out.OnsetAgeDays[i][j])
+		}
+		rescaleHistogram(out.OnsetAgeDays[i], out.PublishCount[i])
+
+		for j := range out.UploadLatencySec[i] {
+			out.UploadLatencySec[i][j] = addNoise32(out.UploadLatencySec[i][j])
+		}
+		rescaleHistogram(out.UploadLatencySec[i], out.PublishCount[i])
+	}
+
+	return out
+}
+
+// clone returns a deep copy of h, so Privatize can noise the copy without
+// mutating the original.
+func (h *HealthAuthorityStats) clone() *HealthAuthorityStats {
+	out := *h
+
+	out.PublishCount = append([]int32(nil), h.PublishCount...)
+	out.MissingOnset = append([]int32(nil), h.MissingOnset...)
+	out.Anomalies = append([]AnomalyFlag(nil), h.Anomalies...)
+
+	out.OldestTekDays = make([][]int32, len(h.OldestTekDays))
+	for i, bucket := range h.OldestTekDays {
+		out.OldestTekDays[i] = append([]int32(nil), bucket...)
+	}
+	out.OnsetAgeDays = make([][]int32, len(h.OnsetAgeDays))
+	for i, bucket := range h.OnsetAgeDays {
+		out.OnsetAgeDays[i] = append([]int32(nil), bucket...)
+	}
+	out.UploadLatencySec = make([][]int32, len(h.UploadLatencySec))
+	for i, bucket := range h.UploadLatencySec {
+		out.UploadLatencySec[i] = append([]int32(nil), bucket...)
+	}
+
+	return &out
+}
+
+// rescaleHistogram proportionally scales buckets down so their sum doesn't
+// exceed max, preserving relative bucket weights. It is a no-op if the
+// buckets already sum to at most max.
+func rescaleHistogram(buckets []int32, max int32) {
+	total := sumInt32(buckets)
+	if total <= int64(max) || total == 0 {
+		return
+	}
+
+	scale := float64(max) / float64(total)
+	for i, v := range buckets {
+		buckets[i] = int32(math.Floor(float64(v) * scale))
+	}
+
+	// Flooring each bucket independently can still leave the sum a hair
+	// over max due to floating-point error; trim the excess off the
+	// largest buckets so the invariant holds exactly.
+	excess := sumInt32(buckets) - int64(max)
+	for excess > 0 {
+		largest := 0
+		for i := range buckets {
+			if buckets[i] > buckets[largest] {
+				largest = i
+			}
+		}
+		if buckets[largest] == 0 {
+			break
+		}
+		buckets[largest]--
+		excess--
+	}
+}
+
+func mustSampleLaplace(rand io.Reader, b float64) float64 {
+	x, err := sampleLaplace(rand, b)
+	if err != nil {
+		panic(fmt.Sprintf("model: sampling Laplace noise: %v", err))
+	}
+	return x
+}
+
+func mustSampleDiscreteGaussian(rand io.Reader, sigma float64) int64 {
+	x, err := sampleDiscreteGaussian(rand, sigma)
+	if err != nil {
+		panic(fmt.Sprintf("model: sampling discrete Gaussian noise: %v", err))
+	}
+	return x
+}
+
+// sampleLaplace draws one sample from Lap(0, b) using inverse-CDF sampling
+// on a uniform random variable in (0, 1).
+func sampleLaplace(rand io.Reader, b float64) (float64, error) {
+	u, err := uniformFloat64(rand)
+	if err != nil {
+		return 0, err
+	}
+	if u < 0.5 {
+		return b * math.Log(2*u), nil
+	}
+	return -b * math.Log(2*(1-u)), nil
+}
+
+// sampleDiscreteGaussian draws one sample from the discrete Gaussian
+// distribution over the integers with standard deviation sigma, using the
+// rejection sampler of Canonne, Kamath, and Steinke (2020): draw from a
+// two-sided geometric envelope and accept with probability proportional to
+// the true discrete Gaussian density.
+func sampleDiscreteGaussian(rand io.Reader, sigma float64) (int64, error) {
+	if sigma <= 0 {
+		return 0, nil
+	}
+
+	t := int64(math.Floor(sigma)) + 1
+	for {
+		y, err := sampleTwoSidedGeometric(rand, t)
+		if err != nil {
+			return 0, err
+		}
+
+		shifted := math.Abs(float64(y)) - sigma*sigma/float64(t)
+		acceptProb := math.Exp(-(shifted * shifted) / (2 * sigma * sigma))
+
+		u, err := uniformFloat64(rand)
+		if err != nil {
+			return 0, err
+		}
+		if u <= acceptProb {
+			return y, nil
+		}
+	}
+}
+
+// sampleTwoSidedGeometric draws from a symmetric geometric distribution on
+// the integers with scale t, used as the envelope for discrete Gaussian
+// rejection sampling.
+func sampleTwoSidedGeometric(rand io.Reader, t int64) (int64, error) {
+	p := 1 - math.Exp(-1/float64(t))
+	for {
+		v, err := sampleGeometric(rand, p)
+		if err != nil {
+			return 0, err
+		}
+		negative, err := uniformBit(rand)
+		if err != nil {
+			return 0, err
+		}
+		if negative == 1 && v == 0 {
+			// Avoid double-weighting zero, which both signs would
+			// otherwise produce.
+			continue
+		}
+		if negative == 1 {
+			return -v, nil
+		}
+		return v, nil
+	}
+}
+
+// sampleGeometric draws from a Geometric(p) distribution on {0, 1, 2, ...}
+// via inverse-CDF sampling.
+func sampleGeometric(rand io.Reader, p float64) (int64, error) {
+	u, err := uniformFloat64(rand)
+	if err != nil {
+		return 0, err
+	}
+	return int64(math.Floor(math.Log(u) / math.Log1p(-p))), nil
+}
+
+// uniformFloat64 reads 8 bytes from rand and returns a uniform float64 in
+// (0, 1), using the top 53 bits for full float64 mantissa precision.
+func uniformFloat64(rand io.Reader) (float64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return 0, fmt.Errorf("reading random bytes: %w", err)
+	}
+	v := binary.BigEndian.Uint64(buf[:]) >> 11
+	if v == 0 {
+		// Nudge away from exactly zero so callers can safely take its log.
+		v = 1
+	}
+	return float64(v) / float64(uint64(1)<<53), nil
+}
+
+// uniformBit reads a single uniform random bit from rand.
+func uniformBit(rand io.Reader) (int, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(rand, buf[:]); err != nil {
+		return 0, fmt.Errorf("reading random byte: %w", err)
+	}
+	return int(buf[0] & 1), nil
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package model
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestSampleNoiseVariance(t *testing.T) {
+	t.Parallel()
+
+	const trials = 20000
+
+	t.Run("laplace", func(t *testing.T) {
+		t.Parallel()
+
+		src := rand.New(rand.NewSource(1))
+		const b = 10.0
+		var sum, sumSq float64
+		for i := 0; i < trials; i++ {
+			x, err := sampleLaplace(src, b)
+			if err != nil {
+				t.Fatalf("sampleLaplace: %v", err)
+			}
+			sum += x
+			sumSq += x * x
+		}
+
+		mean := sum / trials
+		variance := sumSq/trials - mean*mean
+		want := 2 * b * b
+		if relErr := math.Abs(variance-want) / want; relErr > 0.1 {
+			t.Errorf("laplace sample variance = %f, want ~%f (within 10%%)", variance, want)
+		}
+	})
+
+	t.Run("discrete_gaussian", func(t *testing.T) {
+		t.Parallel()
+
+		src := rand.New(rand.NewSource(2))
+		const sigma = 10.0
+		var sum, sumSq float64
+		for i := 0; i < trials; i++ {
+			x, err := sampleDiscreteGaussian(src, sigma)
+			if err != nil {
+				t.Fatalf("sampleDiscreteGaussian: %v", err)
+			}
+			sum += float64(x)
+			sumSq += float64(x) * float64(x)
+		}
+
+		mean := sum / trials
+		variance := sumSq/trials - mean*mean
+		want := sigma * sigma
+		if relErr := math.Abs(variance-want) / want; relErr > 0.15 {
+			t.Errorf("discrete gaussian sample variance = %f, want ~%f (within 15%%)", variance, want)
+		}
+	})
+}
+
+func TestPrivatize(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	record := InitHour(1, now, nil)
+	for i := 0; i < 50; i++ {
+		record.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 14, OldestDays: 14, OnsetDaysAgo: 4})
+	}
+
+	src := rand.New(rand.NewSource(3))
+	params := DPParams{Epsilon: 1, Delta: 1e-5, Sensitivity: 1, Mechanism: Laplace}
+
+	privatized := record.Privatize(src, params)
+
+	if privatized == record {
+		t.Fatal("Privatize must not mutate the receiver in place")
+	}
+	if record.PublishCount[0] != 50 {
+		t.Fatalf("original record was mutated: PublishCount[0] = %d, want 50", record.PublishCount[0])
+	}
+
+	changed := false
+	for i := range platforms {
+		if privatized.PublishCount[i] < 0 || privatized.MissingOnset[i] < 0 {
+			t.Errorf("platform %d: privatized counts must not be negative: %+v", i, privatized)
+		}
+		if got, max := sumInt32(privatized.OldestTekDays[i]), int64(privatized.PublishCount[i]); got > max {
+			t.Errorf("platform %d: sum(OldestTekDays) = %d exceeds PublishCount = %d", i, got, max)
+		}
+		if got, max := sumInt32(privatized.OnsetAgeDays[i]), int64(privatized.PublishCount[i]); got > max {
+			t.Errorf("platform %d: sum(OnsetAgeDays) = %d exceeds PublishCount = %d", i, got, max)
+		}
+		if got, max := sumInt32(privatized.UploadLatencySec[i]), int64(privatized.PublishCount[i]); got > max {
+			t.Errorf("platform %d: sum(UploadLatencySec) = %d exceeds PublishCount = %d", i, got, max)
+		}
+		for j := range privatized.UploadLatencySec[i] {
+			if privatized.UploadLatencySec[i][j] != record.UploadLatencySec[i][j] {
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		t.Error("expected Privatize to add noise to UploadLatencySec, but every bucket matched the un-noised original")
+	}
+}
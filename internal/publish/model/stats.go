@@ -0,0 +1,503 @@
+// Copyright 2020 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package model defines the data model for the publish API.
+package model
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Platform identifies the client platform that submitted a publish request.
+type Platform string
+
+const (
+	PlatformAndroid Platform = "android"
+	PlatformIOS     Platform = "ios"
+	PlatformUnknown Platform = "other"
+)
+
+// platforms is the fixed, ordered set of platforms that per-platform stats
+// are broken down by. The index of a platform in this slice is its index in
+// the per-platform slices on HealthAuthorityStats.
+var platforms = []Platform{PlatformAndroid, PlatformIOS, PlatformUnknown}
+
+const (
+	defaultOldestTekDaysBuckets    = 15
+	defaultOnsetAgeDaysBuckets     = 29
+	defaultLatencyBuckets          = 60
+	defaultLatencyBucketsPerOctave = 4
+)
+
+// StatsConfig controls the shape of the histograms on a HealthAuthorityStats.
+// It is consumed once, by InitHour, and the resulting bucket counts are
+// thereafter implied by the length of the histogram slices; operators can
+// change these without a schema migration, since each hour's stats carry
+// their own bucket boundaries.
+type StatsConfig struct {
+	// OldestTekDaysBuckets is the number of buckets in the OldestTekDays
+	// histogram. Bucket k covers exactly k days, with the last bucket
+	// catching everything at or beyond it.
+	OldestTekDaysBuckets int
+	// OnsetAgeDaysBuckets is the OldestTekDaysBuckets equivalent for
+	// OnsetAgeDays.
+	OnsetAgeDaysBuckets int
+	// LatencyBuckets is the number of buckets in the exponential
+	// UploadLatencySec histogram.
+	LatencyBuckets int
+	// LatencyBucketsPerOctave is the number of UploadLatencySec buckets
+	// per power-of-two (octave) of seconds, e.g. 4 buckets per octave
+	// gives bucket boundaries at roughly 2^(k/4) seconds.
+	LatencyBucketsPerOctave int
+}
+
+// DefaultStatsConfig returns the StatsConfig used when InitHour is called
+// with a nil config.
+func DefaultStatsConfig() *StatsConfig {
+	return &StatsConfig{
+		OldestTekDaysBuckets:    defaultOldestTekDaysBuckets,
+		OnsetAgeDaysBuckets:     defaultOnsetAgeDaysBuckets,
+		LatencyBuckets:          defaultLatencyBuckets,
+		LatencyBucketsPerOctave: defaultLatencyBucketsPerOctave,
+	}
+}
+
+func platformIndex(p Platform) int {
+	switch p {
+	case PlatformAndroid:
+		return 0
+	case PlatformIOS:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// bucket clamps days into [0, numBuckets-1], the same convention used by all
+// of the day-granularity histograms on HealthAuthorityStats.
+func bucket(days, numBuckets int) int {
+	if days < 0 {
+		return 0
+	}
+	if days >= numBuckets {
+		return numBuckets - 1
+	}
+	return days
+}
+
+// latencyBucket maps a latency in seconds onto an exponential histogram with
+// bucketsPerOctave buckets per power-of-two, clamped into [0, numBuckets-1].
+// Bucket 0 catches latencies under one second, including non-positive ones;
+// bucket k for k>0 covers roughly
+// [2^((k-1)/bucketsPerOctave), 2^(k/bucketsPerOctave)) seconds.
+//
+// The octave (integer log2) is read directly off the IEEE 754 exponent bits
+// rather than computed with math.Log2, so placing a sample is O(1): a
+// Float64bits call, a shift, a multiply, and a floor, with no floating-point
+// transcendental function on the hot path.
+func latencyBucket(seconds float64, bucketsPerOctave, numBuckets int) int {
+	if seconds <= 0 || numBuckets <= 1 {
+		return 0
+	}
+
+	bits := math.Float64bits(seconds)
+	exp := int((bits>>52)&0x7ff) - 1023
+	mantissa := bits & (1<<52 - 1)
+	// frac is how far seconds sits between 2^exp and 2^(exp+1), used to
+	// interpolate within the octave without a log call.
+	frac := float64(mantissa) / float64(uint64(1)<<52)
+	log2Seconds := float64(exp) + frac
+
+	idx := int(math.Floor(log2Seconds*float64(bucketsPerOctave))) + 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= numBuckets {
+		idx = numBuckets - 1
+	}
+	return idx
+}
+
+// PublishInfo represents the information about a single publish request,
+// to be used for stats aggregation.
+type PublishInfo struct {
+	Platform             Platform
+	NumTEKs              int32
+	Revision             bool
+	OldestDays           int32
+	OnsetDaysAgo         int32
+	MissingOnset         bool
+	UploadLatencySeconds float64
+}
+
+// HealthAuthorityStats represents statistics for a single health authority
+// for an hour of publish activity. Counters that vary by client platform are
+// broken down per-platform, indexed in platform order (see platforms).
+type HealthAuthorityStats struct {
+	HealthAuthorityID int64
+	Hour              time.Time
+	PublishCount      []int32
+	TEKCount          int64
+	RevisionCount     int32
+	OldestTekDays     [][]int32
+	OnsetAgeDays      [][]int32
+	MissingOnset      []int32
+	UploadLatencySec  [][]int32
+
+	// LatencyBucketsPerOctave records the bucketing used for
+	// UploadLatencySec so that AddPublish and Merge can place and combine
+	// samples without being handed the original StatsConfig again.
+	LatencyBucketsPerOctave int32
+
+	// Anomalies is populated by Check and records which anomaly conditions,
+	// if any, this hour tripped relative to its recent history.
+	Anomalies []AnomalyFlag
+}
+
+// InitHour creates a new, zeroed HealthAuthorityStats for the given health
+// authority and hour. hour is expected to already be truncated to the hour.
+// A nil cfg uses DefaultStatsConfig.
+func InitHour(healthAuthorityID int64, hour time.Time, cfg *StatsConfig) *HealthAuthorityStats {
+	if cfg == nil {
+		cfg = DefaultStatsConfig()
+	}
+
+	oldestTekDays := make([][]int32, len(platforms))
+	onsetAgeDays := make([][]int32, len(platforms))
+	uploadLatencySec := make([][]int32, len(platforms))
+	for i := range platforms {
+		oldestTekDays[i] = make([]int32, cfg.OldestTekDaysBuckets)
+		onsetAgeDays[i] = make([]int32, cfg.OnsetAgeDaysBuckets)
+		uploadLatencySec[i] = make([]int32, cfg.LatencyBuckets)
+	}
+
+	return &HealthAuthorityStats{
+		HealthAuthorityID:       healthAuthorityID,
+		Hour:                    hour,
+		PublishCount:            make([]int32, len(platforms)),
+		OldestTekDays:           oldestTekDays,
+		OnsetAgeDays:            onsetAgeDays,
+		MissingOnset:            make([]int32, len(platforms)),
+		UploadLatencySec:        uploadLatencySec,
+		LatencyBucketsPerOctave: int32(cfg.LatencyBucketsPerOctave),
+	}
+}
+
+// AddPublish folds a single publish request into the per-platform counters
+// and histograms for this hour.
+func (h *HealthAuthorityStats) AddPublish(info *PublishInfo) {
+	idx := platformIndex(info.Platform)
+
+	h.PublishCount[idx]++
+	h.TEKCount += int64(info.NumTEKs)
+	if info.Revision {
+		h.RevisionCount++
+	}
+	h.OldestTekDays[idx][bucket(int(info.OldestDays), len(h.OldestTekDays[idx]))]++
+	h.OnsetAgeDays[idx][bucket(int(info.OnsetDaysAgo), len(h.OnsetAgeDays[idx]))]++
+	h.UploadLatencySec[idx][latencyBucket(info.UploadLatencySeconds, int(h.LatencyBucketsPerOctave), len(h.UploadLatencySec[idx]))]++
+	if info.MissingOnset {
+		h.MissingOnset[idx]++
+	}
+}
+
+// Merge folds another hour's worth of stats for the same health authority
+// and hour into h. It is an error to merge stats for a different health
+// authority or hour.
+func (h *HealthAuthorityStats) Merge(other *HealthAuthorityStats) error {
+	if other == nil {
+		return nil
+	}
+	if other.HealthAuthorityID != h.HealthAuthorityID || !other.Hour.Equal(h.Hour) {
+		return fmt.Errorf("cannot merge stats for health authority %d hour %s into health authority %d hour %s",
+			other.HealthAuthorityID, other.Hour, h.HealthAuthorityID, h.Hour)
+	}
+	if len(other.OldestTekDays[0]) != len(h.OldestTekDays[0]) ||
+		len(other.OnsetAgeDays[0]) != len(h.OnsetAgeDays[0]) ||
+		len(other.UploadLatencySec[0]) != len(h.UploadLatencySec[0]) ||
+		other.LatencyBucketsPerOctave != h.LatencyBucketsPerOctave {
+		return fmt.Errorf("cannot merge stats with mismatched histogram bucketing for health authority %d hour %s", h.HealthAuthorityID, h.Hour)
+	}
+
+	h.TEKCount += other.TEKCount
+	h.RevisionCount += other.RevisionCount
+	for i := range platforms {
+		h.PublishCount[i] += other.PublishCount[i]
+		h.MissingOnset[i] += other.MissingOnset[i]
+		for j := range h.OldestTekDays[i] {
+			h.OldestTekDays[i][j] += other.OldestTekDays[i][j]
+		}
+		for j := range h.OnsetAgeDays[i] {
+			h.OnsetAgeDays[i][j] += other.OnsetAgeDays[i][j]
+		}
+		for j := range h.UploadLatencySec[i] {
+			h.UploadLatencySec[i][j] += other.UploadLatencySec[i][j]
+		}
+	}
+	return nil
+}
+
+// AnomalyFlag identifies a specific kind of statistical anomaly detected in
+// an hour of publish activity relative to its recent history.
+type AnomalyFlag string
+
+const (
+	// AnomalyPublishSpike means PublishCount deviated far above its
+	// rolling mean, e.g. a client bug causing retry storms.
+	AnomalyPublishSpike AnomalyFlag = "publish_spike"
+	// AnomalyTEKDrop means TEKCount deviated far below its rolling mean,
+	// e.g. an upstream outage suppressing submissions.
+	AnomalyTEKDrop AnomalyFlag = "tek_drop"
+	// AnomalyMissingOnsetSurge means the count of publishes missing onset
+	// date deviated far above its rolling mean, e.g. a client regression.
+	AnomalyMissingOnsetSurge AnomalyFlag = "missing_onset_surge"
+)
+
+// AnomalyConfig controls the sensitivity of HealthAuthorityStats.Check.
+type AnomalyConfig struct {
+	// MinSamples is the minimum number of historical hours required before
+	// Check will flag anything; below this there isn't enough history to
+	// estimate a trustworthy mean and standard deviation.
+	MinSamples int
+	// Sigma is the number of standard deviations a metric must deviate
+	// from its rolling mean, in the "bad" direction, to be flagged.
+	Sigma float64
+}
+
+// DefaultAnomalyConfig is the AnomalyConfig used when callers don't have an
+// opinion: a day of hourly history and a 3-sigma threshold.
+func DefaultAnomalyConfig() AnomalyConfig {
+	return AnomalyConfig{
+		MinSamples: 24,
+		Sigma:      3,
+	}
+}
+
+// Check compares h against prev, its recent history for the same health
+// authority, and flags metrics that deviate more than cfg.Sigma standard
+// deviations from their rolling mean. The mean and standard deviation of
+// each metric are computed online over prev via Welford's algorithm. The
+// result is both returned and stored on h.Anomalies.
+//
+// Check returns no flags, and clears h.Anomalies, if fewer than
+// cfg.MinSamples hours of history are available.
+func (h *HealthAuthorityStats) Check(prev []*HealthAuthorityStats, cfg AnomalyConfig) []AnomalyFlag {
+	h.Anomalies = nil
+	if len(prev) < cfg.MinSamples {
+		return nil
+	}
+
+	publishHistory := make([]float64, len(prev))
+	tekHistory := make([]float64, len(prev))
+	missingOnsetHistory := make([]float64, len(prev))
+	for i, p := range prev {
+		publishHistory[i] = float64(sumInt32(p.PublishCount))
+		tekHistory[i] = float64(p.TEKCount)
+		missingOnsetHistory[i] = float64(sumInt32(p.MissingOnset))
+	}
+
+	var flags []AnomalyFlag
+	if deviatesAbove(float64(sumInt32(h.PublishCount)), publishHistory, cfg.Sigma) {
+		flags = append(flags, AnomalyPublishSpike)
+	}
+	if deviatesBelow(float64(h.TEKCount), tekHistory, cfg.Sigma) {
+		flags = append(flags, AnomalyTEKDrop)
+	}
+	if deviatesAbove(float64(sumInt32(h.MissingOnset)), missingOnsetHistory, cfg.Sigma) {
+		flags = append(flags, AnomalyMissingOnsetSurge)
+	}
+
+	h.Anomalies = flags
+	return flags
+}
+
+// welford computes the mean and population standard deviation of samples
+// using Welford's online algorithm, which avoids the numerical instability
+// of accumulating sum(x) and sum(x^2) separately.
+func welford(samples []float64) (mean, stddev float64) {
+	var m, sumSquaredDelta float64
+	for i, x := range samples {
+		delta := x - m
+		m += delta / float64(i+1)
+		sumSquaredDelta += delta * (x - m)
+	}
+	if len(samples) > 0 {
+		stddev = math.Sqrt(sumSquaredDelta / float64(len(samples)))
+	}
+	return m, stddev
+}
+
+// deviatesAbove reports whether x is more than sigma standard deviations
+// above the mean of history.
+func deviatesAbove(x float64, history []float64, sigma float64) bool {
+	mean, stddev := welford(history)
+	if stddev == 0 {
+		// A perfectly flat history has no scale to measure sigmas against;
+		// treat any deviation at all as anomalous.
+		return x > mean
+	}
+	return (x-mean)/stddev > sigma
+}
+
+// deviatesBelow reports whether x is more than sigma standard deviations
+// below the mean of history.
+func deviatesBelow(x float64, history []float64, sigma float64) bool {
+	mean, stddev := welford(history)
+	if stddev == 0 {
+		return x < mean
+	}
+	return (mean-x)/stddev > sigma
+}
+
+func sumInt32(xs []int32) int64 {
+	var total int64
+	for _, x := range xs {
+		total += int64(x)
+	}
+	return total
+}
+
+// StatsRow is a flattened, per-(hour, platform) view of a HealthAuthorityStats
+// suitable for export, since JSON and CSV don't lend themselves well to the
+// nested, per-platform slices on HealthAuthorityStats itself.
+type StatsRow struct {
+	HealthAuthorityID int64         `json:"health_authority_id"`
+	Hour              time.Time     `json:"hour"`
+	Platform          Platform      `json:"platform"`
+	PublishCount      int32         `json:"publish_count"`
+	TEKCount          int64         `json:"tek_count"`
+	RevisionCount     int32         `json:"revision_count"`
+	OldestTekDays     []int32       `json:"oldest_tek_days"`
+	OnsetAgeDays      []int32       `json:"onset_age_days"`
+	MissingOnset      int32         `json:"missing_onset"`
+	UploadLatencySec  []int32       `json:"upload_latency_sec"`
+	Anomalies         []AnomalyFlag `json:"anomalies"`
+}
+
+// Rows flattens h into one StatsRow per platform, even for platforms with no
+// activity in this hour.
+func (h *HealthAuthorityStats) Rows() []*StatsRow {
+	rows := make([]*StatsRow, len(platforms))
+	for i, p := range platforms {
+		rows[i] = &StatsRow{
+			HealthAuthorityID: h.HealthAuthorityID,
+			Hour:              h.Hour,
+			Platform:          p,
+			PublishCount:      h.PublishCount[i],
+			TEKCount:          h.TEKCount,
+			RevisionCount:     h.RevisionCount,
+			OldestTekDays:     h.OldestTekDays[i],
+			OnsetAgeDays:      h.OnsetAgeDays[i],
+			MissingOnset:      h.MissingOnset[i],
+			UploadLatencySec:  h.UploadLatencySec[i],
+			Anomalies:         h.Anomalies,
+		}
+	}
+	return rows
+}
+
+// MarshalStatsJSON renders stats as a JSON array of per-(hour, platform)
+// rows.
+func MarshalStatsJSON(stats []*HealthAuthorityStats) ([]byte, error) {
+	var rows []*StatsRow
+	for _, s := range stats {
+		rows = append(rows, s.Rows()...)
+	}
+
+	b, err := json.MarshalIndent(rows, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshaling stats: %w", err)
+	}
+	return b, nil
+}
+
+var csvHeader = []string{
+	"health_authority_id",
+	"hour",
+	"platform",
+	"publish_count",
+	"tek_count",
+	"revision_count",
+	"oldest_tek_days",
+	"onset_age_days",
+	"missing_onset",
+	"upload_latency_sec",
+	"anomalies",
+}
+
+// MarshalStatsCSV renders stats as a CSV with one row per (hour, platform).
+// The histogram columns are semicolon-delimited bucket counts.
+func MarshalStatsCSV(stats []*HealthAuthorityStats) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	if err := w.Write(csvHeader); err != nil {
+		return nil, fmt.Errorf("writing csv header: %w", err)
+	}
+
+	for _, s := range stats {
+		for _, row := range s.Rows() {
+			record := []string{
+				strconv.FormatInt(row.HealthAuthorityID, 10),
+				row.Hour.Format(time.RFC3339),
+				string(row.Platform),
+				strconv.FormatInt(int64(row.PublishCount), 10),
+				strconv.FormatInt(row.TEKCount, 10),
+				strconv.FormatInt(int64(row.RevisionCount), 10),
+				formatInt32Slice(row.OldestTekDays),
+				formatInt32Slice(row.OnsetAgeDays),
+				strconv.FormatInt(int64(row.MissingOnset), 10),
+				formatInt32Slice(row.UploadLatencySec),
+				formatAnomalyFlags(row.Anomalies),
+			}
+			if err := w.Write(record); err != nil {
+				return nil, fmt.Errorf("writing csv row: %w", err)
+			}
+		}
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return nil, fmt.Errorf("flushing csv: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func formatInt32Slice(s []int32) string {
+	var buf bytes.Buffer
+	for i, v := range s {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(strconv.FormatInt(int64(v), 10))
+	}
+	return buf.String()
+}
+
+func formatAnomalyFlags(flags []AnomalyFlag) string {
+	var buf bytes.Buffer
+	for i, f := range flags {
+		if i > 0 {
+			buf.WriteByte(';')
+		}
+		buf.WriteString(string(f))
+	}
+	return buf.String()
+}
@@ -15,6 +15,7 @@
 package model
 
 import (
+	"strings"
 	"testing"
 	"time"
 
@@ -25,9 +26,9 @@ func TestCheckAddPublish(t *testing.T) {
 	t.Parallel()
 
 	now := time.Now().UTC().Truncate(time.Hour)
-	record := InitHour(1, now)
+	record := InitHour(1, now, nil)
 
-	want := InitHour(1, now)
+	want := InitHour(1, now, nil)
 	compare(want, record, t)
 
 	{
@@ -42,16 +43,12 @@ func TestCheckAddPublish(t *testing.T) {
 
 		record.AddPublish(&info)
 
-		want = &HealthAuthorityStats{
-			HealthAuthorityID: want.HealthAuthorityID,
-			Hour:              want.Hour,
-			PublishCount:      []int32{1, 0, 0},
-			TEKCount:          14,
-			RevisionCount:     0,
-			OldestTekDays:     []int32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
-			OnsetAgeDays:      []int32{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			MissingOnset:      0,
-		}
+		want = InitHour(1, now, nil)
+		want.PublishCount[0] = 1
+		want.TEKCount = 14
+		want.OldestTekDays[0][14] = 1
+		want.OnsetAgeDays[0][4] = 1
+		want.UploadLatencySec[0][0] = 1
 		compare(want, record, t)
 	}
 
@@ -67,16 +64,12 @@ func TestCheckAddPublish(t *testing.T) {
 
 		record.AddPublish(&info)
 
-		want = &HealthAuthorityStats{
-			HealthAuthorityID: want.HealthAuthorityID,
-			Hour:              want.Hour,
-			PublishCount:      []int32{1, 1, 0},
-			TEKCount:          24,
-			RevisionCount:     1,
-			OldestTekDays:     []int32{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1},
-			OnsetAgeDays:      []int32{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			MissingOnset:      0,
-		}
+		want.PublishCount[1] = 1
+		want.TEKCount = 24
+		want.RevisionCount = 1
+		want.OldestTekDays[1][10] = 1
+		want.OnsetAgeDays[1][3] = 1
+		want.UploadLatencySec[1][0] = 1
 		compare(want, record, t)
 	}
 
@@ -92,23 +85,187 @@ func TestCheckAddPublish(t *testing.T) {
 
 		record.AddPublish(&info)
 
-		want = &HealthAuthorityStats{
-			HealthAuthorityID: want.HealthAuthorityID,
-			Hour:              want.Hour,
-			PublishCount:      []int32{1, 1, 1},
-			TEKCount:          29,
-			RevisionCount:     1,
-			OldestTekDays:     []int32{0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 1},
-			OnsetAgeDays:      []int32{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0},
-			MissingOnset:      1,
-		}
+		want.PublishCount[2] = 1
+		want.TEKCount = 29
+		want.OldestTekDays[2][5] = 1
+		want.OnsetAgeDays[2][4] = 1
+		want.MissingOnset[2] = 1
+		want.UploadLatencySec[2][0] = 1
 		compare(want, record, t)
 	}
 }
 
+func TestMerge(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+
+	a := InitHour(1, now, nil)
+	a.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 14, OldestDays: 14, OnsetDaysAgo: 4})
+
+	b := InitHour(1, now, nil)
+	b.AddPublish(&PublishInfo{Platform: PlatformIOS, NumTEKs: 10, OldestDays: 10, OnsetDaysAgo: 3, MissingOnset: true})
+
+	if err := a.Merge(b); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := InitHour(1, now, nil)
+	want.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 14, OldestDays: 14, OnsetDaysAgo: 4})
+	want.AddPublish(&PublishInfo{Platform: PlatformIOS, NumTEKs: 10, OldestDays: 10, OnsetDaysAgo: 3, MissingOnset: true})
+	compare(want, a, t)
+
+	other := InitHour(2, now, nil)
+	if err := a.Merge(other); err == nil {
+		t.Fatal("expected error merging mismatched health authority")
+	}
+}
+
+func TestMarshalStats(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	record := InitHour(1, now, nil)
+	record.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 14, OldestDays: 14, OnsetDaysAgo: 4})
+	record.Anomalies = []AnomalyFlag{AnomalyPublishSpike}
+
+	stats := []*HealthAuthorityStats{record}
+
+	jsonBytes, err := MarshalStatsJSON(stats)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(jsonBytes), `"platform": "android"`) {
+		t.Errorf("expected json to contain android platform row, got: %s", jsonBytes)
+	}
+	if !strings.Contains(string(jsonBytes), string(AnomalyPublishSpike)) {
+		t.Errorf("expected json to contain flagged anomaly, got: %s", jsonBytes)
+	}
+
+	csvBytes, err := MarshalStatsCSV(stats)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(csvBytes)), "\n")
+	if got, want := len(lines), 1+len(platforms); got != want {
+		t.Errorf("expected %d lines (header + one per platform), got %d: %s", want, got, csvBytes)
+	}
+	if !strings.Contains(lines[0], "anomalies") {
+		t.Errorf("expected csv header to contain anomalies column, got: %s", lines[0])
+	}
+	if !strings.Contains(string(csvBytes), string(AnomalyPublishSpike)) {
+		t.Errorf("expected csv to contain flagged anomaly, got: %s", csvBytes)
+	}
+}
+
+func TestStatsConfig(t *testing.T) {
+	t.Parallel()
+
+	cfg := &StatsConfig{
+		OldestTekDaysBuckets:    5,
+		OnsetAgeDaysBuckets:     5,
+		LatencyBuckets:          8,
+		LatencyBucketsPerOctave: 2,
+	}
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	record := InitHour(1, now, cfg)
+
+	if got, want := len(record.OldestTekDays[0]), 5; got != want {
+		t.Errorf("OldestTekDays buckets = %d, want %d", got, want)
+	}
+	if got, want := len(record.UploadLatencySec[0]), 8; got != want {
+		t.Errorf("UploadLatencySec buckets = %d, want %d", got, want)
+	}
+
+	record.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 1, OldestDays: 100, OnsetDaysAgo: 100, UploadLatencySeconds: 1000})
+
+	if got := record.OldestTekDays[0][4]; got != 1 {
+		t.Errorf("expected overflowing OldestDays to land in the last bucket, got counts %v", record.OldestTekDays[0])
+	}
+	if got := record.UploadLatencySec[0][7]; got != 1 {
+		t.Errorf("expected large latency to land in the last bucket, got counts %v", record.UploadLatencySec[0])
+	}
+}
+
+func TestLatencyBucketMonotonic(t *testing.T) {
+	t.Parallel()
+
+	const bucketsPerOctave = 4
+	const numBuckets = 40
+
+	prev := latencyBucket(0, bucketsPerOctave, numBuckets)
+	for seconds := 0.01; seconds < 1e6; seconds *= 1.3 {
+		idx := latencyBucket(seconds, bucketsPerOctave, numBuckets)
+		if idx < prev {
+			t.Fatalf("latencyBucket(%f) = %d, not monotonic with previous bucket %d", seconds, idx, prev)
+		}
+		if idx < 0 || idx >= numBuckets {
+			t.Fatalf("latencyBucket(%f) = %d out of range [0, %d)", seconds, idx, numBuckets)
+		}
+		prev = idx
+	}
+}
+
+func TestCheckAnomalies(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now().UTC().Truncate(time.Hour)
+	cfg := AnomalyConfig{MinSamples: 24, Sigma: 3}
+
+	var prev []*HealthAuthorityStats
+	for i := 0; i < 24; i++ {
+		hour := InitHour(1, now.Add(-time.Duration(i+1)*time.Hour), nil)
+		for j := 0; j < 10; j++ {
+			hour.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 10})
+		}
+		prev = append(prev, hour)
+	}
+
+	// A normal hour, in line with history, should not be flagged.
+	normal := InitHour(1, now, nil)
+	for j := 0; j < 10; j++ {
+		normal.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 10})
+	}
+	if got := normal.Check(prev, cfg); len(got) != 0 {
+		t.Errorf("expected no anomalies for a typical hour, got %v", got)
+	}
+
+	// A hour with a huge publish spike and no TEKs should flag both.
+	spike := InitHour(1, now, nil)
+	for j := 0; j < 1000; j++ {
+		spike.AddPublish(&PublishInfo{Platform: PlatformAndroid, NumTEKs: 0})
+	}
+	got := spike.Check(prev, cfg)
+	if !containsFlag(got, AnomalyPublishSpike) {
+		t.Errorf("expected %s, got %v", AnomalyPublishSpike, got)
+	}
+	if !containsFlag(got, AnomalyTEKDrop) {
+		t.Errorf("expected %s, got %v", AnomalyTEKDrop, got)
+	}
+	if diff := cmp.Diff(got, spike.Anomalies); diff != "" {
+		t.Errorf("Check result not stored on Anomalies (-got, +Anomalies):\n%s", diff)
+	}
+
+	// Without enough history, Check should not flag anything.
+	tooFewSamples := InitHour(1, now, nil)
+	if got := tooFewSamples.Check(prev[:1], cfg); len(got) != 0 {
+		t.Errorf("expected no anomalies with insufficient history, got %v", got)
+	}
+}
+
+func containsFlag(flags []AnomalyFlag, want AnomalyFlag) bool {
+	for _, f := range flags {
+		if f == want {
+			return true
+		}
+	}
+	return false
+}
+
 func compare(want, got *HealthAuthorityStats, t *testing.T) {
 	t.Helper()
 	if diff := cmp.Diff(want, got); diff != "" {
 		t.Fatalf("mismatch (-want, +got):\n%s", diff)
 	}
-}
\ No newline at end of file
+}